@@ -0,0 +1,229 @@
+package verify
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"math"
+
+	"github.com/stellar/go/support/errors"
+)
+
+// bloomOverflowSize bounds how many of the most recently Add-ed keys
+// BloomTempSet keeps an exact record of. It exists solely to disambiguate
+// the false negatives a counting Bloom filter can produce on Remove; it is
+// not a general substitute for the filter.
+const bloomOverflowSize = 10000
+
+// BloomTempSet is a StateVerifyTempSet implementation backed by a counting
+// Bloom filter instead of an exact set. MemoryStateVerifyTempSet stores every
+// key in a map, which on pubnet-sized account/offer sets can run to
+// gigabytes; BloomTempSet uses roughly 1/10th of that memory by trading exact
+// membership for a configurable false-positive rate.
+//
+// Because counting Bloom filters can produce false negatives on Remove (a
+// counter saturates and is decremented below its true value by unrelated
+// keys sharing that position), BloomTempSet keeps a small overflow of the
+// most recently added keys, and will consult an optional DBCheck callback,
+// before reporting a key as missing.
+type BloomTempSet struct {
+	// DBCheck, if set, is consulted when a key appears to be missing on
+	// Remove and the key is not found in the overflow either. It should
+	// report whether key was actually Add-ed to the set.
+	DBCheck func(key string) (bool, error)
+
+	m uint64 // number of counters
+	k uint64 // number of hash functions
+
+	counters []byte // 4-bit saturating counters, packed two per byte
+
+	overflow     map[string]int
+	overflowKeys []string
+}
+
+// NewBloomStateVerifyTempSet creates a BloomTempSet sized for n expected
+// entries with target false-positive rate p (0 < p < 1). It returns an error
+// if n is 0 or p is outside (0, 1). n = 0 sizes no usable filter, and p = 0
+// sends the sizing math to +Inf, which would otherwise surface as an
+// attempt to allocate an exabyte-scale counter array in Open, crashing the
+// process instead of reporting the bad config.
+func NewBloomStateVerifyTempSet(n uint64, p float64) (*BloomTempSet, error) {
+	if n == 0 {
+		return nil, errors.New("n must be greater than 0")
+	}
+	if p <= 0 || p >= 1 {
+		return nil, errors.New("p must be between 0 and 1, exclusive")
+	}
+
+	k := uint64(math.Ceil(-math.Log2(p)))
+	if k < 1 {
+		k = 1
+	}
+
+	m := uint64(math.Ceil(-float64(n) * math.Log(p) / (math.Ln2 * math.Ln2)))
+	if m < 1 {
+		m = 1
+	}
+
+	return &BloomTempSet{m: m, k: k}, nil
+}
+
+// Open allocates the counter array and overflow map.
+func (s *BloomTempSet) Open() error {
+	s.counters = make([]byte, (s.m+2)/2)
+	s.overflow = make(map[string]int)
+	s.overflowKeys = nil
+	return nil
+}
+
+// Add inserts key into the filter. Duplicate detection is only reliable
+// while the key is still tracked in the overflow; outside that window a
+// duplicate Add is, like in any Bloom filter, accepted silently.
+func (s *BloomTempSet) Add(key string) error {
+	if n, ok := s.overflow[key]; ok && n > 0 {
+		return errKeyAlreadyExists
+	}
+
+	for _, pos := range s.positions(key) {
+		s.incr(pos)
+	}
+	s.rememberAdd(key)
+	return nil
+}
+
+// Remove decrements the counters for key. A "key not found" is only raised
+// when one of the k counters for key is already zero, and the overflow (and
+// DBCheck, if set) both fail to confirm the key was actually added. Even
+// when a rescue confirms the key, every non-zero counter for it is still
+// decremented: leaving them alone would leak residual weight into the
+// filter and make IsEmpty falsely report leftover entries later on.
+func (s *BloomTempSet) Remove(key string) error {
+	positions := s.positions(key)
+
+	zero := false
+	for _, pos := range positions {
+		if s.get(pos) == 0 {
+			zero = true
+			break
+		}
+	}
+
+	if zero {
+		confirmed, err := s.confirmAdded(key)
+		if err != nil {
+			return err
+		}
+		if !confirmed {
+			return errKeyNotFound
+		}
+	}
+
+	for _, pos := range positions {
+		// decr is a no-op on a counter that's already zero, so it's safe to
+		// call unconditionally here.
+		s.decr(pos)
+	}
+	s.forgetAdd(key)
+	return nil
+}
+
+// confirmAdded reports whether key was genuinely added despite one of its
+// counters reading zero, by consulting the overflow and, failing that,
+// DBCheck.
+func (s *BloomTempSet) confirmAdded(key string) (bool, error) {
+	if n, ok := s.overflow[key]; ok && n > 0 {
+		return true, nil
+	}
+
+	if s.DBCheck != nil {
+		return s.DBCheck(key)
+	}
+
+	return false, nil
+}
+
+// IsEmpty reports whether every counter is zero.
+func (s *BloomTempSet) IsEmpty() (bool, error) {
+	for _, b := range s.counters {
+		if b != 0 {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// Close releases the counter array and overflow map.
+func (s *BloomTempSet) Close() error {
+	s.counters = nil
+	s.overflow = nil
+	s.overflowKeys = nil
+	return nil
+}
+
+// positions returns the k counter indices for key, derived from the key's
+// sha256 digest split into two 64-bit lanes and combined with the standard
+// Kirsch-Mitzenmacher double-hashing technique (h_i = lane0 + i*lane1) to
+// produce k well-distributed positions from a single hash.
+func (s *BloomTempSet) positions(key string) []uint64 {
+	sum := sha256.Sum256([]byte(key))
+	lane0 := binary.BigEndian.Uint64(sum[0:8])
+	lane1 := binary.BigEndian.Uint64(sum[8:16])
+
+	positions := make([]uint64, s.k)
+	for i := uint64(0); i < s.k; i++ {
+		positions[i] = (lane0 + i*lane1) % s.m
+	}
+	return positions
+}
+
+func (s *BloomTempSet) get(pos uint64) byte {
+	b := s.counters[pos/2]
+	if pos%2 == 0 {
+		return b & 0x0F
+	}
+	return b >> 4
+}
+
+func (s *BloomTempSet) incr(pos uint64) {
+	idx := pos / 2
+	if pos%2 == 0 {
+		if s.counters[idx]&0x0F != 0x0F {
+			s.counters[idx]++
+		}
+	} else if s.counters[idx]&0xF0 != 0xF0 {
+		s.counters[idx] += 0x10
+	}
+}
+
+func (s *BloomTempSet) decr(pos uint64) {
+	idx := pos / 2
+	if pos%2 == 0 {
+		if s.counters[idx]&0x0F != 0 {
+			s.counters[idx]--
+		}
+	} else if s.counters[idx]&0xF0 != 0 {
+		s.counters[idx] -= 0x10
+	}
+}
+
+// rememberAdd records key in the FIFO overflow of recently added keys,
+// evicting the oldest entry once the overflow exceeds bloomOverflowSize.
+func (s *BloomTempSet) rememberAdd(key string) {
+	s.overflow[key]++
+	s.overflowKeys = append(s.overflowKeys, key)
+
+	if len(s.overflowKeys) > bloomOverflowSize {
+		oldest := s.overflowKeys[0]
+		s.overflowKeys = s.overflowKeys[1:]
+		s.forgetAdd(oldest)
+	}
+}
+
+func (s *BloomTempSet) forgetAdd(key string) {
+	if n, ok := s.overflow[key]; ok {
+		if n <= 1 {
+			delete(s.overflow, key)
+		} else {
+			s.overflow[key] = n - 1
+		}
+	}
+}
@@ -0,0 +1,50 @@
+package verify
+
+import "context"
+
+// probeTempSet is a StateVerifyTempSet that only tracks whether a single
+// target key was ever Add-ed, for use by DBContainsKey.
+type probeTempSet struct {
+	target string
+	found  bool
+}
+
+func (p *probeTempSet) Open() error { return nil }
+
+func (p *probeTempSet) Add(key string) error {
+	if key == p.target {
+		p.found = true
+	}
+	return nil
+}
+
+func (p *probeTempSet) Remove(key string) error { return nil }
+
+func (p *probeTempSet) IsEmpty() (bool, error) { return true, nil }
+
+func (p *probeTempSet) Close() error { return nil }
+
+// DBContainsKey reports whether key was ever Add-ed by re-running Seed on
+// every given module against a throwaway StateVerifier. It's meant to back
+// BloomTempSet.DBCheck: an expensive, rarely-invoked fallback that
+// disambiguates a Bloom-filter false negative from a genuinely missing key
+// by re-querying the DB directly instead of trusting the filter.
+func DBContainsKey(ctx context.Context, modules []VerifyModule, key string) (bool, error) {
+	probe := &probeTempSet{target: key}
+
+	v := &StateVerifier{TempSet: probe}
+	for _, module := range modules {
+		v.AddModule(module)
+	}
+
+	if err := v.Open(); err != nil {
+		return false, err
+	}
+	defer v.Close()
+
+	if err := v.Seed(ctx); err != nil {
+		return false, err
+	}
+
+	return probe.found, nil
+}
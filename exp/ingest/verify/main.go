@@ -3,6 +3,7 @@
 package verify
 
 import (
+	"context"
 	"crypto/sha256"
 	"encoding/base64"
 	stdio "io"
@@ -17,6 +18,34 @@ var (
 	errKeyAlreadyExists = errors.New("Key already exists")
 )
 
+// KeyNotFoundError is a more specific alternative to the errKeyNotFound
+// sentinel, for StateVerifyTempSet implementations that batch Remove calls:
+// they may only detect a missing key once a later call flushes the batch
+// the key was buffered into, so the key that was actually missing isn't
+// necessarily the one passed to the Remove call that returned the error.
+// Key reports which one it actually was.
+type KeyNotFoundError struct {
+	Key string
+}
+
+func (e *KeyNotFoundError) Error() string { return errKeyNotFound.Error() }
+
+func (e *KeyNotFoundError) Unwrap() error { return errKeyNotFound }
+
+// keyNotFound reports whether err is errKeyNotFound, whether returned
+// directly or wrapped in a KeyNotFoundError, and returns the key it
+// identifies as missing if there is a more specific one than fallback.
+func keyNotFound(err error, fallback string) (key string, ok bool) {
+	var notFound *KeyNotFoundError
+	if errors.As(err, &notFound) {
+		return notFound.Key, true
+	}
+	if err == errKeyNotFound {
+		return fallback, true
+	}
+	return "", false
+}
+
 // TempSet is an interface that must be implemented by stores that
 // hold temporary set of objects for StateVerifier. The implementation
 // does not need to be thread-safe.
@@ -39,13 +68,26 @@ type StateVerifyTempSet interface {
 	Close() error
 }
 
-// TransformLedgerEntryFunction is a function that transforms ledger entry
-// into a form that should be compared to checkpoint state. It can be also used
-// to decide if the given entry should be ignored during verification.
-// Sometimes the application needs only specific type entries or specific fields
-// for a given entry type. Use this function to create a common form of an entry
-// that will be used for equality check.
-type TransformLedgerEntryFunction func(xdr.LedgerEntry) (ignore bool, newEntry xdr.LedgerEntry)
+// VerifyModule verifies a subset of ledger entry types. StateVerifier keeps a
+// registry of modules indexed by the entry types they report from Types, and
+// dispatches each checkpoint entry to the module registered for its type;
+// entry types with no registered module are ignored. This lets callers (and
+// downstream forks) add verification for entry types this package doesn't
+// know about (claimable balances, liquidity pools, ...) by implementing a new
+// VerifyModule instead of patching StateVerifier itself.
+type VerifyModule interface {
+	// Types returns the ledger entry types this module verifies.
+	Types() []xdr.LedgerEntryType
+	// Transform converts (or ignores) a ledger entry streamed from checkpoint
+	// buckets into the canonical form that should be compared to the entries
+	// added by Seed. Sometimes the application needs only specific fields for
+	// a given entry type; use this to create a common form of an entry that
+	// will be used for the equality check.
+	Transform(entry xdr.LedgerEntry) (ignore bool, canonical xdr.LedgerEntry)
+	// Seed streams this module's rows from the DB and adds them to verifier
+	// via verifier.Add.
+	Seed(ctx context.Context, verifier *StateVerifier) error
+}
 
 // StateVerifier verifies if ledger entries provided by Add method are the same
 // as in the checkpoint ledger entries provided by SingleLedgerStateReader.
@@ -54,12 +96,60 @@ type StateVerifier struct {
 	StateReader *io.SingleLedgerStateReader
 	// TempSet is a StateVerifyTempSet implementation.
 	TempSet StateVerifyTempSet
-	// TransformFunction transforms (or ignores) ledger entries streamed from
-	// checkpoint buckets to match the form added by `Add`. Read
-	// TransformLedgerEntryFunction godoc for more information.
-	TransformFunction TransformLedgerEntryFunction
+
+	modules map[xdr.LedgerEntryType]VerifyModule
+
+	// resume holds, per entry type, the key of the last entry processed in a
+	// prior call to Verify (in this process or a previous one). Entries are
+	// skipped until that key is seen again; since Seed has no notion of
+	// resuming and re-adds every row regardless, skipped entries are still
+	// removed from TempSet so they don't linger and fail IsEmpty. See
+	// SetResume.
+	resume map[xdr.LedgerEntryType]string
+	// lastProcessed holds, per entry type, the key of the last entry removed
+	// from TempSet by any Verify call on this StateVerifier so far. See
+	// LastProcessed.
+	lastProcessed map[xdr.LedgerEntryType]string
 
 	stateCorruptedError error
+	mismatchEntryType   xdr.LedgerEntryType
+	mismatchKey         string
+}
+
+// SetResume configures per-entry-type resume points. It must be called, if
+// at all, before Verify: entries streamed from checkpoint buckets are
+// skipped, and removed from TempSet as if they had matched normally, until
+// the recorded key for their type is seen again, after which Verify
+// continues normally. This lets a batched or restarted verification run pick
+// up where a previous Verify call on the same ledger left off, since the
+// checkpoint bucket stream is deterministic for a given ledger and Seed
+// re-adds every row to TempSet regardless of resume progress.
+func (v *StateVerifier) SetResume(points map[xdr.LedgerEntryType]string) {
+	v.resume = make(map[xdr.LedgerEntryType]string, len(points))
+	for entryType, key := range points {
+		v.resume[entryType] = key
+	}
+}
+
+// LastProcessed returns, for each entry type with at least one entry removed
+// from TempSet by a Verify call on this StateVerifier, the key of the last
+// entry processed; it is not reset between Verify calls. Callers doing batched verification should persist this after
+// any Verify call that returns done=false and pass it to SetResume on the
+// StateVerifier used to continue.
+func (v *StateVerifier) LastProcessed() map[xdr.LedgerEntryType]string {
+	return v.lastProcessed
+}
+
+// AddModule registers module for every entry type it reports from Types.
+// Registering a module for a type that already has one overwrites the
+// earlier registration.
+func (v *StateVerifier) AddModule(module VerifyModule) {
+	if v.modules == nil {
+		v.modules = make(map[xdr.LedgerEntryType]VerifyModule)
+	}
+	for _, t := range module.Types() {
+		v.modules[t] = module
+	}
 }
 
 func (v *StateVerifier) Open() error {
@@ -90,41 +180,130 @@ func (v *StateVerifier) entryToKey(entry xdr.LedgerEntry) (string, error) {
 	return key, nil
 }
 
+// Seed runs Seed on every module registered with AddModule, so their rows are
+// added to the verifier before Verify is called.
+func (v *StateVerifier) Seed(ctx context.Context) error {
+	seeded := make(map[xdr.LedgerEntryType]bool)
+	for entryType, module := range v.modules {
+		if seeded[entryType] {
+			// A module can be registered for more than one entry type; only
+			// seed it once.
+			continue
+		}
+		for _, t := range module.Types() {
+			seeded[t] = true
+		}
+
+		if err := module.Seed(ctx, v); err != nil {
+			return errors.Wrapf(err, "Error seeding module for %s", entryType)
+		}
+	}
+	return nil
+}
+
 // Verify checks if (transformed) ledger entries from checkpoint buckets match
 // entries provided by `Add`.
-// Returns (false, nil) if state found to be invalid. Use `StateError` to get
-// actual reason why the state is found to be invalid. For other errors, it
-// returns (true, err).
-func (v *StateVerifier) Verify() (bool, error) {
+//
+// maxEntries bounds how many entries are removed from TempSet before Verify
+// returns, so a caller can persist LastProcessed and commit its own
+// transaction between calls instead of holding one DB transaction for a
+// potentially very long verification run. Pass maxEntries <= 0 to process
+// the whole checkpoint in a single call, matching the original behavior.
+//
+// Returns (done, valid, err). done is false only when maxEntries was reached
+// before the checkpoint was fully consumed; the caller should persist
+// LastProcessed and call Verify again, either on the same StateVerifier to
+// continue in-process, or on a freshly constructed one with SetResume called
+// from the persisted progress after a restart.
+//
+// valid is false if state was found to be invalid; use StateError to get the
+// reason. For other errors, done is true and err is non-nil.
+func (v *StateVerifier) Verify(maxEntries int) (done bool, valid bool, err error) {
+	processed := 0
 	for {
+		if maxEntries > 0 && processed >= maxEntries {
+			return false, true, nil
+		}
+
 		entryChange, err := v.StateReader.Read()
 		if err != nil {
 			if err == stdio.EOF {
 				break
 			}
-			return true, err
+			return true, false, err
+		}
+
+		handled, corrupted, err := v.processEntry(entryChange.MustState())
+		if err != nil {
+			return true, false, err
 		}
+		if corrupted {
+			return true, false, nil
+		}
+		if handled {
+			processed++
+		}
+	}
+
+	empty, err := v.TempSet.IsEmpty()
+	if err != nil {
+		v.stateCorruptedError = errors.New("Some entries added in Add has not been found in history archives")
+		return true, false, err
+	}
 
-		entry := entryChange.MustState()
-		preTransformEntry := entry
+	return true, empty, nil
+}
+
+// processEntry dispatches a single checkpoint entry to its registered
+// module and reconciles it against TempSet. handled is true if the entry
+// was matched and removed from TempSet, counting towards maxEntries in
+// Verify; corrupted is true if the entry revealed invalid state, in which
+// case StateError and Mismatch describe it and Verify should stop.
+func (v *StateVerifier) processEntry(entry xdr.LedgerEntry) (handled bool, corrupted bool, err error) {
+	preTransformEntry := entry
+
+	module, ok := v.modules[entry.Data.Type]
+	if !ok {
+		// No module registered for this entry type, ignore it.
+		return false, false, nil
+	}
+
+	ignore, transformed := module.Transform(entry)
+	if ignore {
+		return false, false, nil
+	}
+	entry = transformed
+
+	key, err := v.entryToKey(entry)
+	if err != nil {
+		return false, false, err
+	}
 
-		var ignore bool
-		if v.TransformFunction != nil {
-			ignore, entry = v.TransformFunction(entry)
-			if ignore {
-				continue
+	if resumeKey, resuming := v.resume[entry.Data.Type]; resuming {
+		// Seed re-adds every row on every run (it has no notion of
+		// resuming), so the keys in the already-processed range are
+		// present in TempSet even though we're skipping past them here;
+		// remove them too, or they'd never be matched and IsEmpty would
+		// wrongly report leftover entries at the end of this run.
+		if err := v.TempSet.Remove(key); err != nil {
+			if _, ok := keyNotFound(err, key); !ok {
+				return false, false, err
 			}
 		}
-
-		key, err := v.entryToKey(entry)
-		if err != nil {
-			return true, err
+		if key == resumeKey {
+			delete(v.resume, entry.Data.Type)
 		}
+		return false, false, nil
+	}
 
-		err = v.TempSet.Remove(key)
-		if err != nil {
-			if err == errKeyNotFound {
-				// We ignore errors here because "corrupted state error" has a priority
+	err = v.TempSet.Remove(key)
+	if err != nil {
+		if missingKey, ok := keyNotFound(err, key); ok {
+			v.mismatchEntryType = entry.Data.Type
+			v.mismatchKey = missingKey
+
+			// We ignore errors here because "corrupted state error" has a priority
+			if missingKey == key {
 				entryMarshaled, _ := entry.MarshalBinary()
 				preTransformEntryMarshaled, _ := preTransformEntry.MarshalBinary()
 
@@ -134,19 +313,25 @@ func (v *StateVerifier) Verify() (bool, error) {
 					base64.StdEncoding.EncodeToString(entryMarshaled),
 					key,
 				)
-				return false, nil
+			} else {
+				// The implementation batches Remove calls, so the missing
+				// key was only detected once a later flush ran; we don't
+				// have the offending entry's bytes on hand to log, only
+				// its key.
+				v.stateCorruptedError = errors.Errorf(
+					"Could not find key %s in added entries", missingKey,
+				)
 			}
-			return true, err
+			return false, true, nil
 		}
+		return false, false, err
 	}
 
-	empty, err := v.TempSet.IsEmpty()
-	if err != nil {
-		v.stateCorruptedError = errors.New("Some entries added in Add has not been found in history archives")
-		return true, err
+	if v.lastProcessed == nil {
+		v.lastProcessed = make(map[xdr.LedgerEntryType]string)
 	}
-
-	return empty, nil
+	v.lastProcessed[entry.Data.Type] = key
+	return true, false, nil
 }
 
 // StateError returns an explanation why the state is corrupted if
@@ -154,3 +339,12 @@ func (v *StateVerifier) Verify() (bool, error) {
 func (v *StateVerifier) StateError() error {
 	return v.stateCorruptedError
 }
+
+// Mismatch returns the entry type and key of the entry that caused
+// StateError, if the mismatch was a "not found in added entries" case (the
+// common case). It returns the zero value and an empty key for the rarer
+// "entries left over in TempSet after the checkpoint was consumed" case,
+// since that doesn't point at a single offending entry.
+func (v *StateVerifier) Mismatch() (xdr.LedgerEntryType, string) {
+	return v.mismatchEntryType, v.mismatchKey
+}
@@ -0,0 +1,153 @@
+package verify
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stellar/go/xdr"
+)
+
+// Two arbitrary, well-formed Stellar account addresses (distinct strkey
+// checksums) used as stand-ins for real ledger entries below.
+const (
+	testAddressOne = "GAAQCAIBAEAQCAIBAEAQCAIBAEAQCAIBAEAQCAIBAEAQCAIBAEAQDZ7H"
+	testAddressTwo = "GABAEAQCAIBAEAQCAIBAEAQCAIBAEAQCAIBAEAQCAIBAEAQCAIBAEJXA"
+)
+
+// fakeModule is a verify.VerifyModule that seeds a fixed, deterministic set
+// of account entries and passes every account entry through unchanged, so
+// tests can assert on StateVerifier's dispatch and reconciliation logic
+// without depending on a real DB-backed module.
+type fakeModule struct {
+	// seed holds the addresses Seed will Add to the verifier.
+	seed []string
+}
+
+func (m *fakeModule) Types() []xdr.LedgerEntryType {
+	return []xdr.LedgerEntryType{xdr.LedgerEntryTypeAccount}
+}
+
+func (m *fakeModule) Transform(entry xdr.LedgerEntry) (bool, xdr.LedgerEntry) {
+	return false, entry
+}
+
+func (m *fakeModule) Seed(ctx context.Context, verifier *StateVerifier) error {
+	for _, address := range m.seed {
+		if err := verifier.Add(accountEntry(address)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func accountEntry(address string) xdr.LedgerEntry {
+	return xdr.LedgerEntry{
+		Data: xdr.LedgerEntryData{
+			Type: xdr.LedgerEntryTypeAccount,
+			Account: &xdr.AccountEntry{
+				AccountId: xdr.MustAddress(address),
+			},
+		},
+	}
+}
+
+func newTestVerifier(t *testing.T, seed []string) *StateVerifier {
+	t.Helper()
+
+	v := &StateVerifier{TempSet: &MemoryStateVerifyTempSet{}}
+	v.AddModule(&fakeModule{seed: seed})
+
+	if err := v.Open(); err != nil {
+		t.Fatalf("Open returned error: %v", err)
+	}
+	t.Cleanup(func() {
+		if err := v.Close(); err != nil {
+			t.Fatalf("Close returned error: %v", err)
+		}
+	})
+
+	if err := v.Seed(context.Background()); err != nil {
+		t.Fatalf("Seed returned error: %v", err)
+	}
+
+	return v
+}
+
+func TestStateVerifierDispatchesMatchingEntries(t *testing.T) {
+	v := newTestVerifier(t, []string{testAddressOne, testAddressTwo})
+
+	handled, corrupted, err := v.processEntry(accountEntry(testAddressOne))
+	if err != nil {
+		t.Fatalf("processEntry returned error: %v", err)
+	}
+	if corrupted {
+		t.Fatalf("processEntry reported corruption for a seeded entry")
+	}
+	if !handled {
+		t.Fatalf("processEntry did not report a registered entry type as handled")
+	}
+
+	handled, corrupted, err = v.processEntry(accountEntry(testAddressTwo))
+	if err != nil {
+		t.Fatalf("processEntry returned error: %v", err)
+	}
+	if corrupted {
+		t.Fatalf("processEntry reported corruption for a seeded entry")
+	}
+	if !handled {
+		t.Fatalf("processEntry did not report a registered entry type as handled")
+	}
+
+	empty, err := v.TempSet.IsEmpty()
+	if err != nil {
+		t.Fatalf("IsEmpty returned error: %v", err)
+	}
+	if !empty {
+		t.Fatalf("TempSet is not empty after every seeded entry was processed")
+	}
+}
+
+func TestStateVerifierIgnoresUnregisteredTypes(t *testing.T) {
+	v := newTestVerifier(t, []string{testAddressOne})
+
+	entry := xdr.LedgerEntry{Data: xdr.LedgerEntryData{Type: xdr.LedgerEntryTypeOffer}}
+	handled, corrupted, err := v.processEntry(entry)
+	if err != nil {
+		t.Fatalf("processEntry returned error: %v", err)
+	}
+	if corrupted {
+		t.Fatalf("processEntry reported corruption for an unregistered entry type")
+	}
+	if handled {
+		t.Fatalf("processEntry reported an unregistered entry type as handled")
+	}
+}
+
+func TestStateVerifierDetectsCorruption(t *testing.T) {
+	v := newTestVerifier(t, []string{testAddressOne})
+
+	// testAddressTwo was never seeded, so it should be reported as a
+	// corrupted, unmatched entry rather than silently ignored.
+	handled, corrupted, err := v.processEntry(accountEntry(testAddressTwo))
+	if err != nil {
+		t.Fatalf("processEntry returned error: %v", err)
+	}
+	if handled {
+		t.Fatalf("processEntry reported an unmatched entry as handled")
+	}
+	if !corrupted {
+		t.Fatalf("processEntry did not detect an entry missing from added entries")
+	}
+
+	if v.StateError() == nil {
+		t.Fatalf("StateError is nil after a detected corruption")
+	}
+
+	entryType, key := v.Mismatch()
+	if entryType != xdr.LedgerEntryTypeAccount {
+		t.Fatalf("Mismatch entry type = %v, want %v", entryType, xdr.LedgerEntryTypeAccount)
+	}
+	if key == "" {
+		t.Fatalf("Mismatch key is empty")
+	}
+}
@@ -0,0 +1,226 @@
+package verify
+
+import (
+	"database/sql"
+
+	sq "github.com/Masterminds/squirrel"
+	"github.com/lib/pq"
+	"github.com/stellar/go/support/errors"
+)
+
+// postgresStateVerifyBatchSize is the number of keys buffered in memory
+// before Add/Remove round-trip to the database. Flushing in batches keeps
+// verifier throughput reasonable when checking pubnet-sized account sets.
+const postgresStateVerifyBatchSize = 5000
+
+// PostgresStateVerifyTempSet is a StateVerifyTempSet implementation backed by
+// an unlogged Postgres table rather than an in-memory map. Unlike
+// MemoryStateVerifyTempSet, it does not hold the entire accounts+signers set
+// in process memory, which is required on pubnet where that set no longer
+// fits on small Horizon hosts.
+//
+// PostgresStateVerifyTempSet must be used within the same DB transaction for
+// its entire lifetime: Open creates (or truncates, if reused) an
+// `ON COMMIT DROP` table, so the table disappears automatically when the
+// transaction ends.
+type PostgresStateVerifyTempSet struct {
+	tx *sql.Tx
+
+	mode         postgresStateVerifyMode
+	addBuffer    []string
+	removeBuffer []string
+}
+
+type postgresStateVerifyMode int
+
+const (
+	postgresStateVerifyModeNone postgresStateVerifyMode = iota
+	postgresStateVerifyModeAdd
+	postgresStateVerifyModeRemove
+)
+
+// NewPostgresStateVerifyTempSet creates a new PostgresStateVerifyTempSet that
+// writes to `state_verify_keys` using the given transaction.
+func NewPostgresStateVerifyTempSet(tx *sql.Tx) *PostgresStateVerifyTempSet {
+	return &PostgresStateVerifyTempSet{tx: tx}
+}
+
+// Open creates the backing table if it does not exist yet and truncates it,
+// so the same PostgresStateVerifyTempSet can be reused across several
+// verification runs sharing a transaction.
+func (s *PostgresStateVerifyTempSet) Open() error {
+	_, err := s.tx.Exec(`
+		CREATE UNLOGGED TABLE IF NOT EXISTS state_verify_keys (
+			key text PRIMARY KEY
+		) ON COMMIT DROP
+	`)
+	if err != nil {
+		return errors.Wrap(err, "Error creating state_verify_keys table")
+	}
+
+	_, err = s.tx.Exec(`TRUNCATE TABLE state_verify_keys`)
+	if err != nil {
+		return errors.Wrap(err, "Error truncating state_verify_keys table")
+	}
+
+	s.mode = postgresStateVerifyModeNone
+	s.addBuffer = nil
+	s.removeBuffer = nil
+	return nil
+}
+
+// Add adds a key to TempSet. It returns errKeyAlreadyExists if any of the
+// keys in the flushed batch already exists in the table.
+func (s *PostgresStateVerifyTempSet) Add(key string) error {
+	if s.mode == postgresStateVerifyModeRemove {
+		if err := s.flushRemove(); err != nil {
+			return err
+		}
+	}
+	s.mode = postgresStateVerifyModeAdd
+
+	s.addBuffer = append(s.addBuffer, key)
+	if len(s.addBuffer) >= postgresStateVerifyBatchSize {
+		return s.flushAdd()
+	}
+	return nil
+}
+
+// Remove removes a key from TempSet. It returns a *KeyNotFoundError
+// identifying the actual missing key if any of the keys in the flushed
+// batch does not exist in the table -- which, because Remove only flushes
+// once the buffer fills (or on IsEmpty), may not be the key this particular
+// call was for.
+func (s *PostgresStateVerifyTempSet) Remove(key string) error {
+	if s.mode == postgresStateVerifyModeAdd {
+		if err := s.flushAdd(); err != nil {
+			return err
+		}
+	}
+	s.mode = postgresStateVerifyModeRemove
+
+	s.removeBuffer = append(s.removeBuffer, key)
+	if len(s.removeBuffer) >= postgresStateVerifyBatchSize {
+		return s.flushRemove()
+	}
+	return nil
+}
+
+// IsEmpty flushes any buffered Add/Remove calls and checks if the table is
+// empty.
+func (s *PostgresStateVerifyTempSet) IsEmpty() (bool, error) {
+	if err := s.flushAdd(); err != nil {
+		return false, err
+	}
+	if err := s.flushRemove(); err != nil {
+		return false, err
+	}
+	s.mode = postgresStateVerifyModeNone
+
+	var empty bool
+	err := s.tx.QueryRow(`SELECT NOT EXISTS(SELECT 1 FROM state_verify_keys)`).Scan(&empty)
+	if err != nil {
+		return false, errors.Wrap(err, "Error checking if state_verify_keys is empty")
+	}
+
+	return empty, nil
+}
+
+// Close releases the in-memory Add/Remove buffers. It does not drop the
+// backing table: because the table is created with `ON COMMIT DROP`, it goes
+// away once the surrounding transaction ends.
+func (s *PostgresStateVerifyTempSet) Close() error {
+	s.addBuffer = nil
+	s.removeBuffer = nil
+	return nil
+}
+
+func (s *PostgresStateVerifyTempSet) flushAdd() error {
+	if len(s.addBuffer) == 0 {
+		return nil
+	}
+
+	insert := sq.Insert("state_verify_keys").Columns("key")
+	for _, key := range s.addBuffer {
+		insert = insert.Values(key)
+	}
+
+	// ON CONFLICT DO NOTHING turns a duplicate key into a row silently
+	// dropped from the RETURNING set, rather than a unique-violation error
+	// that would abort the whole transaction, so the row-count comparison
+	// below is what actually detects it.
+	query, args, err := insert.Suffix("ON CONFLICT (key) DO NOTHING RETURNING key").ToSql()
+	if err != nil {
+		return errors.Wrap(err, "Error building batch insert query")
+	}
+
+	rows, err := s.tx.Query(query, args...)
+	if err != nil {
+		return errors.Wrap(err, "Error running batch insert query")
+	}
+	defer rows.Close()
+
+	inserted := 0
+	for rows.Next() {
+		inserted++
+	}
+	if err := rows.Err(); err != nil {
+		return errors.Wrap(err, "Error reading batch insert results")
+	}
+
+	added := len(s.addBuffer)
+	s.addBuffer = s.addBuffer[:0]
+
+	if inserted != added {
+		return errKeyAlreadyExists
+	}
+	return nil
+}
+
+// flushRemove executes the buffered Remove calls as a single batch delete.
+// Since any one key's Remove call may return before the batch it was
+// buffered into is actually flushed, a missing key can't be reported
+// synchronously from its own Remove call; instead, on a cardinality
+// mismatch, flushRemove re-checks which of the buffered keys is still
+// present and returns its identity in a *KeyNotFoundError, so callers can
+// attribute the failure to the key that was actually missing rather than
+// whichever key's Remove call happened to trigger this flush.
+func (s *PostgresStateVerifyTempSet) flushRemove() error {
+	if len(s.removeBuffer) == 0 {
+		return nil
+	}
+
+	rows, err := s.tx.Query(`
+		DELETE FROM state_verify_keys WHERE key = ANY($1) RETURNING key
+	`, pq.Array(s.removeBuffer))
+	if err != nil {
+		return errors.Wrap(err, "Error running batch delete query")
+	}
+
+	deleted := make(map[string]bool, len(s.removeBuffer))
+	for rows.Next() {
+		var key string
+		if err := rows.Scan(&key); err != nil {
+			rows.Close()
+			return errors.Wrap(err, "Error reading batch delete results")
+		}
+		deleted[key] = true
+	}
+	if err := rows.Err(); err != nil {
+		rows.Close()
+		return errors.Wrap(err, "Error reading batch delete results")
+	}
+	rows.Close()
+
+	removeBuffer := s.removeBuffer
+	s.removeBuffer = s.removeBuffer[:0]
+
+	if len(deleted) != len(removeBuffer) {
+		for _, key := range removeBuffer {
+			if !deleted[key] {
+				return &KeyNotFoundError{Key: key}
+			}
+		}
+	}
+	return nil
+}
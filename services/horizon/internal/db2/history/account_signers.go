@@ -39,24 +39,61 @@ func (q *Q) AccountsForSigner(signer string, page db2.PageQuery) ([]AccountSigne
 	return results, nil
 }
 
+// accountSignersBatchSize is the number of rows sent per multi-VALUES
+// INSERT by batchUpsertAccountSigners. Bulk ingest of a checkpoint round
+// trips one row at a time otherwise, which dominates wall time.
+const accountSignersBatchSize = 1000
+
 // InsertAccountSigner creates a row in the accounts_signers table
 func (q *Q) InsertAccountSigner(account, signer string, weight int32) error {
-	sql := sq.Insert("accounts_signers").
-		Columns("account", "signer", "weight").
-		Values(account, signer, weight)
-	_, err := q.Exec(sql)
-	return err
+	return q.BatchInsertAccountSigners([]AccountSigner{
+		{Account: account, Signer: signer, Weight: weight},
+	})
 }
 
 // UpsertAccountSigner creates a row in the accounts_signers table
 func (q *Q) UpsertAccountSigner(account, signer string, weight int32) error {
-	sql := sq.Insert("accounts_signers").
-		Columns("account", "signer", "weight").
-		Values(account, signer, weight).
-		Suffix("ON CONFLICT (signer, account) DO UPDATE SET weight=EXCLUDED.weight")
+	return q.batchUpsertAccountSigners([]AccountSigner{
+		{Account: account, Signer: signer, Weight: weight},
+	}, true)
+}
 
-	_, err := q.Exec(sql)
-	return err
+// BatchInsertAccountSigners creates a row in the accounts_signers table for
+// every signer, batching them into multi-VALUES INSERT statements of
+// accountSignersBatchSize rows so bulk ingest doesn't round trip once per
+// row.
+func (q *Q) BatchInsertAccountSigners(signers []AccountSigner) error {
+	return q.batchUpsertAccountSigners(signers, false)
+}
+
+func (q *Q) batchUpsertAccountSigners(signers []AccountSigner, upsert bool) error {
+	for start := 0; start < len(signers); start += accountSignersBatchSize {
+		end := start + accountSignersBatchSize
+		if end > len(signers) {
+			end = len(signers)
+		}
+
+		insert := sqInsertAccountSigners(signers[start:end])
+		if upsert {
+			insert = insert.Suffix("ON CONFLICT (signer, account) DO UPDATE SET weight=EXCLUDED.weight")
+		}
+
+		if _, err := q.Exec(insert); err != nil {
+			return errors.Wrap(err, "could not batch insert account signers")
+		}
+	}
+
+	return nil
+}
+
+// sqInsertAccountSigners builds the multi-VALUES INSERT statement for a
+// single batch of signers, without the ON CONFLICT suffix upsert mode adds.
+func sqInsertAccountSigners(signers []AccountSigner) sq.InsertBuilder {
+	insert := sq.Insert("accounts_signers").Columns("account", "signer", "weight")
+	for _, s := range signers {
+		insert = insert.Values(s.Account, s.Signer, s.Weight)
+	}
+	return insert
 }
 
 // RemoveAccountSigner deletes a row in the accounts_signers table
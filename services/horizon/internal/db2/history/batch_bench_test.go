@@ -0,0 +1,94 @@
+package history
+
+import (
+	"testing"
+
+	"github.com/stellar/go/xdr"
+)
+
+// These benchmarks compare building accountSignersBatchSize/offersBatchSize
+// rows as a single multi-VALUES statement (what batchUpsertAccountSigners and
+// batchUpsertOffers do) against building one single-row statement per row
+// (what InsertAccountSigner/UpsertOffer used to do before batching). There's
+// no test database available to exercise the actual Exec round trips in this
+// environment, so these measure statement construction instead -- the part
+// that scales with row count either way, and a reasonable proxy for the
+// round-trip count these changes were meant to cut: one ToSql per batch
+// instead of one per row.
+
+func benchmarkSigners(n int) []AccountSigner {
+	signers := make([]AccountSigner, n)
+	for i := 0; i < n; i++ {
+		signers[i] = AccountSigner{
+			Account: "GAAQCAIBAEAQCAIBAEAQCAIBAEAQCAIBAEAQCAIBAEAQCAIBAEAQDZ7H",
+			Signer:  "GABAEAQCAIBAEAQCAIBAEAQCAIBAEAQCAIBAEAQCAIBAEAQCAIBAEJXA",
+			Weight:  1,
+		}
+	}
+	return signers
+}
+
+func BenchmarkBuildBatchedAccountSignersInsert(b *testing.B) {
+	signers := benchmarkSigners(accountSignersBatchSize)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		insert := sqInsertAccountSigners(signers)
+		if _, _, err := insert.ToSql(); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkBuildSingularAccountSignersInsert(b *testing.B) {
+	signers := benchmarkSigners(accountSignersBatchSize)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for _, s := range signers {
+			insert := sqInsertAccountSigners([]AccountSigner{s})
+			if _, _, err := insert.ToSql(); err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+}
+
+func benchmarkOffers(n int) []xdr.OfferEntry {
+	offers := make([]xdr.OfferEntry, n)
+	for i := 0; i < n; i++ {
+		offers[i] = xdr.OfferEntry{
+			SellerId: xdr.MustAddress("GAAQCAIBAEAQCAIBAEAQCAIBAEAQCAIBAEAQCAIBAEAQCAIBAEAQDZ7H"),
+			OfferId:  xdr.Int64(i),
+			Selling:  xdr.MustNewNativeAsset(),
+			Buying:   xdr.MustNewNativeAsset(),
+			Amount:   100,
+			Price:    xdr.Price{N: 1, D: 1},
+		}
+	}
+	return offers
+}
+
+func BenchmarkBuildBatchedOffersInsert(b *testing.B) {
+	offers := benchmarkOffers(offersBatchSize)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := sqInsertOffers(offers); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkBuildSingularOffersInsert(b *testing.B) {
+	offers := benchmarkOffers(offersBatchSize)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for _, o := range offers {
+			if _, err := sqInsertOffers([]xdr.OfferEntry{o}); err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+}
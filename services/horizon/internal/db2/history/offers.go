@@ -1,6 +1,8 @@
 package history
 
 import (
+	"database/sql"
+
 	sq "github.com/Masterminds/squirrel"
 	"github.com/stellar/go/support/errors"
 	"github.com/stellar/go/xdr"
@@ -13,82 +15,139 @@ func (q *Q) GetAllOffers() ([]Offer, error) {
 	return offers, err
 }
 
-// InsertOffer creates / updates a row in the offers table
-func (q *Q) InsertOffer(offer xdr.OfferEntry) error {
-	var price float64
-	if offer.Price.N > 0 {
-		price = float64(offer.Price.N) / float64(offer.Price.D)
-	} else if offer.Price.D == 0 {
-		return errors.New("offer price denominator is zero")
-	}
-	buyingAsset, err := xdr.MarshalBase64(offer.Buying)
-	if err != nil {
-		return errors.Wrap(err, "cannot marshal buying asset in offer")
-	}
-	sellingAsset, err := xdr.MarshalBase64(offer.Selling)
-	if err != nil {
-		return errors.Wrap(err, "cannot marshal selling asset in offer")
-	}
-	sql := sq.Insert("offers").SetMap(
-		map[string]interface{}{
-			"sellerid":     offer.SellerId.Address(),
-			"offerid":      offer.OfferId,
-			"sellingasset": sellingAsset,
-			"buyingasset":  buyingAsset,
-			"amount":       offer.Amount,
-			"pricen":       offer.Price.N,
-			"priced":       offer.Price.D,
-			"price":        price,
-			"flags":        offer.Flags,
-		},
-	)
+// StreamOffers streams offers from a DB. Used in state verification code.
+func (q *Q) StreamOffers() (*sql.Rows, error) {
+	return sq.Select(
+		"offers.sellerid",
+		"offers.offerid",
+		"offers.sellingasset",
+		"offers.buyingasset",
+		"offers.amount",
+		"offers.pricen",
+		"offers.priced",
+		"offers.flags",
+	).
+		From("offers").
+		OrderBy("offers.offerid ASC").
+		RunWith(q.Session.GetTx().Tx).
+		Query()
+}
 
-	_, err = q.Exec(sql)
-	return err
+// offersBatchSize is the number of rows sent per multi-VALUES INSERT by
+// batchUpsertOffers. Bulk ingest of a checkpoint round trips one row at a
+// time otherwise, which dominates wall time.
+const offersBatchSize = 1000
+
+// OfferBatchInsertError is returned by BatchUpsertOffers (and the singular
+// InsertOffer/UpsertOffer built on top of it) when encoding the buying or
+// selling asset of one of the batched offers fails, so callers can identify
+// exactly which offer in the batch was at fault.
+type OfferBatchInsertError struct {
+	OfferID xdr.Int64
+	Err     error
+}
+
+func (e *OfferBatchInsertError) Error() string {
+	return errors.Wrapf(e.Err, "could not marshal offer %d", e.OfferID).Error()
+}
+
+// InsertOffer creates a row in the offers table
+func (q *Q) InsertOffer(offer xdr.OfferEntry) error {
+	return q.batchUpsertOffers([]xdr.OfferEntry{offer}, false)
 }
 
 // UpsertOffer creates / updates a row in the offers table
 func (q *Q) UpsertOffer(offer xdr.OfferEntry) error {
-	var price float64
-	if offer.Price.N > 0 {
-		price = float64(offer.Price.N) / float64(offer.Price.D)
-	} else if offer.Price.D == 0 {
-		return errors.New("offer price denominator is zero")
-	}
-	buyingAsset, err := xdr.MarshalBase64(offer.Buying)
-	if err != nil {
-		return errors.Wrap(err, "cannot marshal buying asset in offer")
+	return q.batchUpsertOffers([]xdr.OfferEntry{offer}, true)
+}
+
+// BatchUpsertOffers creates / updates a row in the offers table for every
+// offer, batching them into multi-VALUES INSERT ... ON CONFLICT statements of
+// offersBatchSize rows so bulk ingest doesn't round trip once per row.
+func (q *Q) BatchUpsertOffers(offers []xdr.OfferEntry) error {
+	return q.batchUpsertOffers(offers, true)
+}
+
+func (q *Q) batchUpsertOffers(offers []xdr.OfferEntry, upsert bool) error {
+	for start := 0; start < len(offers); start += offersBatchSize {
+		end := start + offersBatchSize
+		if end > len(offers) {
+			end = len(offers)
+		}
+
+		insert, err := sqInsertOffers(offers[start:end])
+		if err != nil {
+			return err
+		}
+
+		if upsert {
+			insert = insert.Suffix(`
+				ON CONFLICT (offerid) DO UPDATE SET
+					sellerid=EXCLUDED.sellerid,
+					sellingasset=EXCLUDED.sellingasset,
+					buyingasset=EXCLUDED.buyingasset,
+					amount=EXCLUDED.amount,
+					pricen=EXCLUDED.pricen,
+					priced=EXCLUDED.priced,
+					price=EXCLUDED.price,
+					flags=EXCLUDED.flags
+			`)
+		}
+
+		if _, err := q.Exec(insert); err != nil {
+			return errors.Wrap(err, "could not batch upsert offers")
+		}
 	}
-	sellingAsset, err := xdr.MarshalBase64(offer.Selling)
-	if err != nil {
-		return errors.Wrap(err, "cannot marshal selling asset in offer")
+
+	return nil
+}
+
+// sqInsertOffers builds the multi-VALUES INSERT statement for a single batch
+// of offers, without the ON CONFLICT suffix upsert mode adds.
+func sqInsertOffers(offers []xdr.OfferEntry) (sq.InsertBuilder, error) {
+	insert := sq.Insert("offers").Columns(
+		"sellerid",
+		"offerid",
+		"sellingasset",
+		"buyingasset",
+		"amount",
+		"pricen",
+		"priced",
+		"price",
+		"flags",
+	)
+
+	for _, offer := range offers {
+		var price float64
+		if offer.Price.N > 0 {
+			price = float64(offer.Price.N) / float64(offer.Price.D)
+		} else if offer.Price.D == 0 {
+			return insert, &OfferBatchInsertError{offer.OfferId, errors.New("offer price denominator is zero")}
+		}
+
+		sellingAsset, err := xdr.MarshalBase64(offer.Selling)
+		if err != nil {
+			return insert, &OfferBatchInsertError{offer.OfferId, errors.Wrap(err, "cannot marshal selling asset in offer")}
+		}
+		buyingAsset, err := xdr.MarshalBase64(offer.Buying)
+		if err != nil {
+			return insert, &OfferBatchInsertError{offer.OfferId, errors.Wrap(err, "cannot marshal buying asset in offer")}
+		}
+
+		insert = insert.Values(
+			offer.SellerId.Address(),
+			offer.OfferId,
+			sellingAsset,
+			buyingAsset,
+			offer.Amount,
+			offer.Price.N,
+			offer.Price.D,
+			price,
+			offer.Flags,
+		)
 	}
-	sql := sq.Insert("offers").SetMap(
-		map[string]interface{}{
-			"sellerid":     offer.SellerId.Address(),
-			"offerid":      offer.OfferId,
-			"sellingasset": sellingAsset,
-			"buyingasset":  buyingAsset,
-			"amount":       offer.Amount,
-			"pricen":       offer.Price.N,
-			"priced":       offer.Price.D,
-			"price":        price,
-			"flags":        offer.Flags,
-		},
-	).Suffix(`
-			ON CONFLICT (offerid) DO UPDATE SET
-				sellerid=EXCLUDED.sellerid,
-				sellingasset=EXCLUDED.sellingasset,
-				buyingasset=EXCLUDED.buyingasset,
-				amount=EXCLUDED.amount,
-				pricen=EXCLUDED.pricen,
-				priced=EXCLUDED.priced,
-				price=EXCLUDED.price,
-				flags=EXCLUDED.flags
-		`)
-
-	_, err = q.Exec(sql)
-	return err
+
+	return insert, nil
 }
 
 // RemoveOffer deletes a row in the offers table
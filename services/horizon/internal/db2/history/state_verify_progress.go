@@ -0,0 +1,99 @@
+package history
+
+import (
+	sq "github.com/Masterminds/squirrel"
+	"github.com/stellar/go/support/errors"
+	"github.com/stellar/go/xdr"
+)
+
+// StateVerifyProgress is a row in the verify_state_progress table. It
+// records, for a single entry type within a single checkpoint ledger, the
+// key of the last entry verify.StateVerifier successfully matched, so a
+// restarted verification run can resume from LastKey instead of starting
+// that entry type over. See verify.StateVerifier.SetResume.
+type StateVerifyProgress struct {
+	LedgerSequence int32  `db:"ledger_sequence"`
+	EntryType      int32  `db:"entry_type"`
+	LastKey        string `db:"last_key"`
+}
+
+// EnsureStateVerifyProgressTables creates the verify_state_progress and
+// verify_state_mismatches tables if they don't exist yet. Unlike
+// state_verify_keys (see PostgresStateVerifyTempSet), these tables are
+// ordinary logged tables that outlive the verifying transaction, since their
+// whole purpose is to survive a process restart.
+func (q *Q) EnsureStateVerifyProgressTables() error {
+	_, err := q.Session.GetTx().Tx.Exec(`
+		CREATE TABLE IF NOT EXISTS verify_state_progress (
+			ledger_sequence integer NOT NULL,
+			entry_type integer NOT NULL,
+			last_key text NOT NULL,
+			PRIMARY KEY (ledger_sequence, entry_type)
+		)
+	`)
+	if err != nil {
+		return errors.Wrap(err, "Error creating verify_state_progress table")
+	}
+
+	_, err = q.Session.GetTx().Tx.Exec(`
+		CREATE TABLE IF NOT EXISTS verify_state_mismatches (
+			ledger_sequence integer NOT NULL,
+			entry_type integer NOT NULL,
+			key text NOT NULL,
+			detected_at timestamp NOT NULL DEFAULT now()
+		)
+	`)
+	if err != nil {
+		return errors.Wrap(err, "Error creating verify_state_mismatches table")
+	}
+
+	return nil
+}
+
+// GetStateVerifyProgress returns the saved progress for ledgerSequence, so a
+// resumed verification run knows where each entry type's checkpoint stream
+// left off.
+func (q *Q) GetStateVerifyProgress(ledgerSequence int32) ([]StateVerifyProgress, error) {
+	sql := sq.Select("ledger_sequence", "entry_type", "last_key").
+		From("verify_state_progress").
+		Where("ledger_sequence = ?", ledgerSequence)
+
+	var results []StateVerifyProgress
+	if err := q.Select(&results, sql); err != nil {
+		return nil, errors.Wrap(err, "could not select verify_state_progress")
+	}
+
+	return results, nil
+}
+
+// UpsertStateVerifyProgress records that entryType's checkpoint stream for
+// ledgerSequence has been consumed up to, and including, lastKey.
+func (q *Q) UpsertStateVerifyProgress(ledgerSequence int32, entryType xdr.LedgerEntryType, lastKey string) error {
+	sql := sq.Insert("verify_state_progress").
+		Columns("ledger_sequence", "entry_type", "last_key").
+		Values(ledgerSequence, int32(entryType), lastKey).
+		Suffix("ON CONFLICT (ledger_sequence, entry_type) DO UPDATE SET last_key=EXCLUDED.last_key")
+
+	_, err := q.Exec(sql)
+	return err
+}
+
+// ClearStateVerifyProgress deletes all progress rows for ledgerSequence. It
+// should be called once a checkpoint has been fully, successfully verified.
+func (q *Q) ClearStateVerifyProgress(ledgerSequence int32) error {
+	sql := sq.Delete("verify_state_progress").Where("ledger_sequence = ?", ledgerSequence)
+	_, err := q.Exec(sql)
+	return err
+}
+
+// RecordStateVerifyMismatch persists the offending entry type and key for
+// ledgerSequence, so a corrupted-state finding survives past the single log
+// line it used to be reported in, for later inspection.
+func (q *Q) RecordStateVerifyMismatch(ledgerSequence int32, entryType xdr.LedgerEntryType, key string) error {
+	sql := sq.Insert("verify_state_mismatches").
+		Columns("ledger_sequence", "entry_type", "key").
+		Values(ledgerSequence, int32(entryType), key)
+
+	_, err := q.Exec(sql)
+	return err
+}
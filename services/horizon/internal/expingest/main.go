@@ -0,0 +1,62 @@
+package expingest
+
+import (
+	"github.com/stellar/go/support/db"
+	"github.com/stellar/go/support/historyarchive"
+	logpkg "github.com/stellar/go/support/log"
+	"github.com/stellar/go/xdr"
+)
+
+var log = logpkg.DefaultLogger.WithField("service", "expingest")
+
+// Config holds the state-verification knobs this package reads from
+// System.config. Other ingest configuration isn't needed by this package's
+// slice of functionality and isn't declared here.
+type Config struct {
+	// StateVerificationBloomFilter selects the state verification TempSet
+	// implementation: false (the default) uses the exact, but
+	// non-resumable, verify.PostgresStateVerifyTempSet, which keeps its keys
+	// in a table bound to a single DB transaction; true switches to
+	// verify.BloomTempSet, an in-memory counting Bloom filter that trades
+	// exact membership for an operator-chosen false-positive rate, and
+	// unlocks resumable, incremental verification.
+	StateVerificationBloomFilter bool
+
+	// StateVerificationCheckEntryTypes lists the additional
+	// xdr.LedgerEntryType values (beyond accounts, which are always
+	// verified) state verification should check. Defaults to nil, i.e.
+	// only accounts are verified. Only xdr.LedgerEntryTypeOffer has a
+	// module to enable; other listed types have no effect.
+	StateVerificationCheckEntryTypes []xdr.LedgerEntryType
+
+	// StateVerificationExpectedEntries sizes verify.BloomTempSet for n
+	// expected entries when StateVerificationBloomFilter is enabled.
+	// Defaults to 0, which NewBloomStateVerifyTempSet rejects: operators
+	// enabling the Bloom filter must set this explicitly to a
+	// pubnet-scale estimate (tens of millions) of entries: one per account
+	// with signers (signers are folded into their account's entry), plus
+	// one per offer when offer verification is enabled.
+	StateVerificationExpectedEntries uint64
+
+	// StateVerificationFalsePositiveRate is the target false-positive
+	// rate for verify.BloomTempSet when StateVerificationBloomFilter is
+	// enabled. Defaults to 0, which NewBloomStateVerifyTempSet rejects:
+	// operators enabling the Bloom filter must set this explicitly; 0.0001
+	// is a reasonable starting point.
+	StateVerificationFalsePositiveRate float64
+}
+
+// Session holds the ingest dependencies state verification reads from.
+type Session struct {
+	Archive historyarchive.ArchiveInterface
+}
+
+// System drives horizon's ledger ingestion. Only the fields state
+// verification (see verify.go) needs are declared here.
+type System struct {
+	config         Config
+	historySession *db.Session
+	session        *Session
+
+	stateVerificationRunning bool
+}
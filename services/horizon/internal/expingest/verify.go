@@ -1,6 +1,7 @@
 package expingest
 
 import (
+	"context"
 	"database/sql"
 	"time"
 
@@ -13,6 +14,22 @@ import (
 	"github.com/stellar/go/xdr"
 )
 
+// stateVerifyBatchSize bounds how many entries verify.StateVerifier removes
+// from TempSet per transaction in resumable mode (see
+// StateVerificationBloomFilter below), so a single checkpoint's worth of
+// state verification -- which can otherwise hold a DB transaction open for
+// 10+ minutes on pubnet -- is broken into many short, progress-committing
+// steps instead.
+const stateVerifyBatchSize = 50000
+
+// waitForPublishedHASPollInterval and waitForPublishedHASMaxPollInterval
+// bound the exponential backoff waitForPublishedHAS uses while polling for
+// stellar-core to publish the ledgerSequence checkpoint.
+const (
+	waitForPublishedHASPollInterval    = time.Second
+	waitForPublishedHASMaxPollInterval = 20 * time.Second
+)
+
 func (s *System) verifyState() error {
 	if s.stateVerificationRunning {
 		log.Warn("State verification is already running...")
@@ -21,27 +38,13 @@ func (s *System) verifyState() error {
 
 	s.stateVerificationRunning = true
 	startTime := time.Now()
-	session := s.historySession.Clone()
-
 	defer func() {
 		log.WithField("duration", time.Since(startTime).Seconds()).Info("State verification finished")
-		session.Rollback()
 		s.stateVerificationRunning = false
 	}()
 
-	err := session.BeginTx(&sql.TxOptions{
-		Isolation: sql.LevelRepeatableRead,
-		ReadOnly:  true,
-	})
-	if err != nil {
-		return errors.Wrap(err, "Error starting transaction")
-	}
-
-	historyQ := &history.Q{session}
-
-	// Ensure the ledger is a checkpoint ledger
-	ledgerSequence, err := historyQ.GetLastLedgerExpIngestNonBlocking()
-	if err != nil {
+	ledgerSequence, err := s.lastIngestedCheckpointLedger()
+	if err != nil || ledgerSequence == 0 {
 		return err
 	}
 
@@ -50,15 +53,95 @@ func (s *System) verifyState() error {
 		"ledger":     ledgerSequence,
 	})
 
+	localLog.Info("Starting state verification...")
+
+	if err := waitForPublishedHAS(s.session.Archive, ledgerSequence); err != nil {
+		return errors.Wrap(err, "Error waiting for stellar-core to publish HAS")
+	}
+
+	if s.config.StateVerificationBloomFilter {
+		// Resumable mode: TempSet doesn't depend on a DB transaction, so
+		// Verify can be split into many short-lived transactions with
+		// progress checkpointed to the DB between them.
+		return s.verifyStateResumable(ledgerSequence, localLog)
+	}
+
+	// PostgresStateVerifyTempSet's backing table only lives for the
+	// transaction it was created in, so this mode keeps verifying in the
+	// single, long-lived transaction it always has -- it isn't resumable,
+	// but it remains available for operators who want an exact comparison
+	// and can tolerate (or don't hit) the DB lock duration.
+	return s.verifyStateSinglePass(ledgerSequence, localLog)
+}
+
+// lastIngestedCheckpointLedger returns the last ledger ingested into the
+// history DB if it's a checkpoint ledger, or 0 (with a nil error) if
+// verification should be skipped for this round, because either no ledger
+// has been ingested yet or the last ingested ledger isn't a checkpoint.
+func (s *System) lastIngestedCheckpointLedger() (uint32, error) {
+	session := s.historySession.Clone()
+	if err := session.BeginTx(&sql.TxOptions{ReadOnly: true}); err != nil {
+		return 0, errors.Wrap(err, "Error starting transaction")
+	}
+	defer session.Rollback()
+
+	historyQ := &history.Q{session}
+	ledgerSequence, err := historyQ.GetLastLedgerExpIngestNonBlocking()
+	if err != nil {
+		return 0, err
+	}
+
 	if !historyarchive.IsCheckpoint(ledgerSequence) {
-		localLog.Info("Current ledger is not a checkpoint ledger. Cancelling...")
-		return nil
+		log.WithField("ledger", ledgerSequence).
+			Info("Current ledger is not a checkpoint ledger. Cancelling state verification...")
+		return 0, nil
 	}
 
-	localLog.Info("Starting state verification...")
+	return ledgerSequence, nil
+}
 
-	// Wait for stellar-core to publish HAS
-	time.Sleep(20 * time.Second)
+// waitForPublishedHAS polls, with exponential backoff, until stellar-core has
+// published the checkpoint for ledgerSequence, replacing a fixed sleep that
+// either waited too long or not long enough depending on how busy core was.
+func waitForPublishedHAS(archive historyarchive.ArchiveInterface, ledgerSequence uint32) error {
+	interval := waitForPublishedHASPollInterval
+	for {
+		has, err := archive.GetRootHAS()
+		if err != nil {
+			return errors.Wrap(err, "Error getting root HAS from history archive")
+		}
+
+		if has.CurrentLedger >= ledgerSequence {
+			return nil
+		}
+
+		time.Sleep(interval)
+		if interval < waitForPublishedHASMaxPollInterval {
+			interval *= 2
+			if interval > waitForPublishedHASMaxPollInterval {
+				interval = waitForPublishedHASMaxPollInterval
+			}
+		}
+	}
+}
+
+// verifyStateSinglePass runs the whole state verification for ledgerSequence
+// within a single REPEATABLE READ transaction, as state verification always
+// used to. It's kept as the default because PostgresStateVerifyTempSet's
+// backing table only exists for the lifetime of that one transaction.
+func (s *System) verifyStateSinglePass(ledgerSequence uint32, localLog *ilog.Entry) error {
+	session := s.historySession.Clone()
+	defer session.Rollback()
+
+	err := session.BeginTx(&sql.TxOptions{
+		Isolation: sql.LevelRepeatableRead,
+		ReadOnly:  true,
+	})
+	if err != nil {
+		return errors.Wrap(err, "Error starting transaction")
+	}
+
+	historyQ := &history.Q{session}
 
 	stateReader, err := io.MakeSingleLedgerStateReader(
 		s.session.Archive,
@@ -70,148 +153,258 @@ func (s *System) verifyState() error {
 	}
 
 	verifier := &verify.StateVerifier{
-		StateReader:       stateReader,
-		TempSet:           &verify.MemoryStateVerifyTempSet{},
-		TransformFunction: transformEntry,
+		StateReader: stateReader,
+		TempSet:     verify.NewPostgresStateVerifyTempSet(session.GetTx().Tx),
 	}
 
-	err = verifier.Open()
-	if err != nil {
+	verifier.AddModule(&AccountsModule{Q: historyQ})
+	if s.checkEntryType(xdr.LedgerEntryTypeOffer) {
+		verifier.AddModule(&OffersModule{Q: historyQ})
+	}
+
+	if err := verifier.Open(); err != nil {
 		return errors.Wrap(err, "Error opening StateVerifier")
 	}
 	defer verifier.Close()
 
-	localLog.Info("Adding accounts to StateVerifier...")
-	err = addAccountsToStateVerifier(verifier, historyQ)
-	if err != nil {
-		return errors.Wrap(err, "addAccountsToStateVerifier failed")
+	localLog.Info("Seeding StateVerifier from history database...")
+	if err := verifier.Seed(context.TODO()); err != nil {
+		return errors.Wrap(err, "verifier.Seed failed")
 	}
-	localLog.Info("Accounts added to StateVerifier")
+	localLog.Info("StateVerifier seeded")
 
 	localLog.Info("Comparing with history archive...")
-	ok, err := verifier.Verify()
+	_, ok, err := verifier.Verify(0)
 	if err != nil {
 		return errors.Wrap(err, "Error running verifier.Verify")
 	}
 
 	if !ok {
-		// STATE IS INVALID! TODO: log reason why
 		localLog.WithField("err", verifier.StateError()).Error("STATE IS INVALID!")
-		// Save invalid state flag to a DB and panic.
-		panic(true)
+		entryType, key := verifier.Mismatch()
+		return s.recordStateVerifyMismatch(ledgerSequence, entryType, key)
 	}
 
 	localLog.Info("State correct")
 	return nil
 }
 
-func addAccountsToStateVerifier(verifier *verify.StateVerifier, q *history.Q) error {
-	rows, err := q.StreamAccounts()
+// verifyStateResumable runs state verification for ledgerSequence using a
+// BloomTempSet, which (unlike the Postgres-backed one) doesn't depend on a
+// single DB transaction. Seeding is done in one short read-only transaction;
+// Verify then proceeds in batches of stateVerifyBatchSize, checkpointing
+// progress to verify_state_progress in its own short transaction between
+// batches. If the process restarts mid-run, it resumes from the last
+// checkpointed key per entry type instead of starting over.
+func (s *System) verifyStateResumable(ledgerSequence uint32, localLog *ilog.Entry) error {
+	progressQ, err := s.newProgressQ()
+	if err != nil {
+		return err
+	}
+	defer progressQ.Session.Rollback()
+
+	if err := progressQ.EnsureStateVerifyProgressTables(); err != nil {
+		return err
+	}
+
+	progress, err := progressQ.GetStateVerifyProgress(int32(ledgerSequence))
+	if err != nil {
+		return err
+	}
+	if err := progressQ.Session.Commit(); err != nil {
+		return errors.Wrap(err, "Error committing progress read")
+	}
+
+	resume := make(map[xdr.LedgerEntryType]string, len(progress))
+	for _, p := range progress {
+		resume[xdr.LedgerEntryType(p.EntryType)] = p.LastKey
+	}
+
+	seedSession := s.historySession.Clone()
+	if err := seedSession.BeginTx(&sql.TxOptions{
+		Isolation: sql.LevelRepeatableRead,
+		ReadOnly:  true,
+	}); err != nil {
+		return errors.Wrap(err, "Error starting seed transaction")
+	}
+	historyQ := &history.Q{seedSession}
+
+	stateReader, err := io.MakeSingleLedgerStateReader(
+		s.session.Archive,
+		&io.MemoryTempSet{}, // TODO change to postgres
+		ledgerSequence,
+	)
 	if err != nil {
-		return errors.Wrap(err, "Error running history.Q.StreamAccounts")
+		seedSession.Rollback()
+		return errors.Wrap(err, "Error running io.MakeSingleLedgerStateReader")
 	}
-	defer rows.Close()
 
-	var account *xdr.AccountEntry
+	bloomSet, err := verify.NewBloomStateVerifyTempSet(
+		s.config.StateVerificationExpectedEntries,
+		s.config.StateVerificationFalsePositiveRate,
+	)
+	if err != nil {
+		seedSession.Rollback()
+		return errors.Wrap(err, "Error creating BloomTempSet")
+	}
+	bloomSet.DBCheck = s.bloomDBCheck
 
-	for rows.Next() {
-		var row history.AccountSigner
-		if err := rows.Scan(&row.Account, &row.Signer, &row.Weight); err != nil {
-			return errors.Wrap(err, "rows.Scan returned error")
+	verifier := &verify.StateVerifier{
+		StateReader: stateReader,
+		TempSet:     bloomSet,
+	}
+	verifier.AddModule(&AccountsModule{Q: historyQ})
+	if s.checkEntryType(xdr.LedgerEntryTypeOffer) {
+		verifier.AddModule(&OffersModule{Q: historyQ})
+	}
+	if len(resume) > 0 {
+		verifier.SetResume(resume)
+	}
+
+	if err := verifier.Open(); err != nil {
+		seedSession.Rollback()
+		return errors.Wrap(err, "Error opening StateVerifier")
+	}
+	defer verifier.Close()
+
+	localLog.Info("Seeding StateVerifier from history database...")
+	if err := verifier.Seed(context.TODO()); err != nil {
+		seedSession.Rollback()
+		return errors.Wrap(err, "verifier.Seed failed")
+	}
+	localLog.Info("StateVerifier seeded")
+	seedSession.Rollback()
+
+	localLog.Info("Comparing with history archive...")
+	for {
+		done, ok, err := verifier.Verify(stateVerifyBatchSize)
+		if err != nil {
+			return errors.Wrap(err, "Error running verifier.Verify")
 		}
 
-		if account == nil || account.AccountId.Address() != row.Account {
-			if account != nil {
-				// Sort signers
-				account.Signers = xdr.SortSignersByKey(account.Signers)
-
-				entry := xdr.LedgerEntry{
-					Data: xdr.LedgerEntryData{
-						Type:    xdr.LedgerEntryTypeAccount,
-						Account: account,
-					},
-				}
-				err := verifier.Add(entry)
-				if err != nil {
-					return err
-				}
-			}
+		if !ok {
+			localLog.WithField("err", verifier.StateError()).Error("STATE IS INVALID!")
+			entryType, key := verifier.Mismatch()
+			return s.recordStateVerifyMismatch(ledgerSequence, entryType, key)
+		}
 
-			account = &xdr.AccountEntry{
-				AccountId: xdr.MustAddress(row.Account),
-				Signers:   []xdr.Signer{},
-			}
+		if err := s.saveStateVerifyProgress(int32(ledgerSequence), verifier.LastProcessed()); err != nil {
+			return err
 		}
 
-		if row.Account == row.Signer {
-			// Master key
-			account.Thresholds = [4]byte{
-				// Store master weight only
-				byte(row.Weight), 0, 0, 0,
-			}
-		} else {
-			// Normal signer
-			account.Signers = append(account.Signers, xdr.Signer{
-				Key:    xdr.MustSigner(row.Signer),
-				Weight: xdr.Uint32(row.Weight),
-			})
+		if done {
+			break
 		}
 	}
 
-	if err := rows.Err(); err != nil {
-		return errors.Wrap(err, "rows.Err returned error")
+	localLog.Info("State correct")
+	return s.clearStateVerifyProgress(int32(ledgerSequence))
+}
+
+// bloomDBCheck is BloomTempSet.DBCheck for verifyStateResumable: it answers
+// "was key genuinely Add-ed" by re-seeding every enabled module against a
+// fresh, short-lived read-only transaction and checking whether key comes
+// up. It's expected to be called rarely -- only when one of a key's Bloom
+// counters unexpectedly reads zero on Remove -- since it re-streams the
+// whole accounts_signers/offers tables each time. It can't reuse
+// seedSession, since that's rolled back well before Verify, and any
+// Remove-triggered check, can run.
+func (s *System) bloomDBCheck(key string) (bool, error) {
+	session := s.historySession.Clone()
+	if err := session.BeginTx(&sql.TxOptions{ReadOnly: true}); err != nil {
+		return false, errors.Wrap(err, "Error starting DBCheck transaction")
+	}
+	defer session.Rollback()
+
+	historyQ := &history.Q{session}
+	modules := []verify.VerifyModule{&AccountsModule{Q: historyQ}}
+	if s.checkEntryType(xdr.LedgerEntryTypeOffer) {
+		modules = append(modules, &OffersModule{Q: historyQ})
+	}
+
+	return verify.DBContainsKey(context.TODO(), modules, key)
+}
+
+func (s *System) newProgressQ() (*history.Q, error) {
+	session := s.historySession.Clone()
+	if err := session.BeginTx(&sql.TxOptions{}); err != nil {
+		return nil, errors.Wrap(err, "Error starting progress transaction")
+	}
+	return &history.Q{session}, nil
+}
+
+func (s *System) saveStateVerifyProgress(ledgerSequence int32, lastProcessed map[xdr.LedgerEntryType]string) error {
+	progressQ, err := s.newProgressQ()
+	if err != nil {
+		return err
+	}
+	defer progressQ.Session.Rollback()
+
+	for entryType, key := range lastProcessed {
+		if err := progressQ.UpsertStateVerifyProgress(ledgerSequence, entryType, key); err != nil {
+			return errors.Wrap(err, "Error upserting verify_state_progress")
+		}
 	}
 
-	// Add last created in a loop account
-	entry := xdr.LedgerEntry{
-		Data: xdr.LedgerEntryData{
-			Type:    xdr.LedgerEntryTypeAccount,
-			Account: account,
-		},
+	if err := progressQ.Session.Commit(); err != nil {
+		return errors.Wrap(err, "Error committing verify_state_progress")
 	}
-	err = verifier.Add(entry)
+	return nil
+}
+
+func (s *System) clearStateVerifyProgress(ledgerSequence int32) error {
+	progressQ, err := s.newProgressQ()
 	if err != nil {
 		return err
 	}
+	defer progressQ.Session.Rollback()
 
+	if err := progressQ.ClearStateVerifyProgress(ledgerSequence); err != nil {
+		return errors.Wrap(err, "Error clearing verify_state_progress")
+	}
+
+	if err := progressQ.Session.Commit(); err != nil {
+		return errors.Wrap(err, "Error committing verify_state_progress clear")
+	}
 	return nil
 }
 
-func transformEntry(entry xdr.LedgerEntry) (bool, xdr.LedgerEntry) {
-	switch entry.Data.Type {
-	case xdr.LedgerEntryTypeAccount:
-		accountEntry := entry.Data.Account
+func (s *System) recordStateVerifyMismatch(ledgerSequence uint32, entryType xdr.LedgerEntryType, key string) error {
+	progressQ, err := s.newProgressQ()
+	if err != nil {
+		return err
+	}
+	defer progressQ.Session.Rollback()
 
-		// We don't store account accounts with no signers (including master).
-		// Ignore such accounts for now.
-		if accountEntry.MasterKeyWeight() == 0 && len(accountEntry.Signers) == 0 {
-			return true, xdr.LedgerEntry{}
-		}
+	if err := progressQ.RecordStateVerifyMismatch(int32(ledgerSequence), entryType, key); err != nil {
+		return errors.Wrap(err, "Error recording verify_state_mismatches")
+	}
+
+	if err := progressQ.Session.Commit(); err != nil {
+		return errors.Wrap(err, "Error committing verify_state_mismatches")
+	}
+	return nil
+}
 
-		// We store account id, master weight and signers only
-		return false, xdr.LedgerEntry{
-			Data: xdr.LedgerEntryData{
-				Type: xdr.LedgerEntryTypeAccount,
-				Account: &xdr.AccountEntry{
-					AccountId: accountEntry.AccountId,
-					Thresholds: [4]byte{
-						// Store master weight only
-						accountEntry.Thresholds[0], 0, 0, 0,
-					},
-					Signers: xdr.SortSignersByKey(accountEntry.Signers),
-				},
-			},
+// checkEntryType returns true if state verification for entryType has been
+// enabled via the StateVerificationCheckEntryTypes config option. Accounts
+// are always verified; offers are gated behind this flag so operators can
+// roll out their verification incrementally, by registering (or not)
+// OffersModule. No module exists for trustlines or data entries, so listing
+// those types has no effect.
+func (s *System) checkEntryType(entryType xdr.LedgerEntryType) bool {
+	for _, t := range s.config.StateVerificationCheckEntryTypes {
+		if t == entryType {
+			return true
 		}
-	case xdr.LedgerEntryTypeTrustline:
-		// Ignore
-		return true, xdr.LedgerEntry{}
-	case xdr.LedgerEntryTypeOffer:
-		// TODO check offers
-		return true, xdr.LedgerEntry{}
-	case xdr.LedgerEntryTypeData:
-		// Ignore
-		return true, xdr.LedgerEntry{}
-	default:
-		panic("Invalid type")
 	}
+	return false
 }
+
+// StateVerificationBloomFilter, StateVerificationExpectedEntries and
+// StateVerificationFalsePositiveRate let operators trade the exact (but
+// non-resumable) PostgresStateVerifyTempSet for a verify.BloomTempSet, an
+// in-memory counting Bloom filter with an operator-chosen false-positive
+// rate, which -- because it doesn't
+// depend on a DB transaction -- unlocks resumable, incremental verification
+// via verifyStateResumable.
@@ -0,0 +1,206 @@
+package expingest
+
+import (
+	"context"
+
+	"github.com/stellar/go/exp/ingest/verify"
+	"github.com/stellar/go/services/horizon/internal/db2/history"
+	"github.com/stellar/go/support/errors"
+	"github.com/stellar/go/xdr"
+)
+
+// AccountsModule is a verify.VerifyModule that verifies xdr.LedgerEntryTypeAccount
+// entries by comparing the accounts_signers table against checkpoint buckets.
+type AccountsModule struct {
+	Q *history.Q
+}
+
+func (m *AccountsModule) Types() []xdr.LedgerEntryType {
+	return []xdr.LedgerEntryType{xdr.LedgerEntryTypeAccount}
+}
+
+func (m *AccountsModule) Transform(entry xdr.LedgerEntry) (bool, xdr.LedgerEntry) {
+	accountEntry := entry.Data.Account
+
+	// We don't store account accounts with no signers (including master).
+	// Ignore such accounts for now.
+	if accountEntry.MasterKeyWeight() == 0 && len(accountEntry.Signers) == 0 {
+		return true, xdr.LedgerEntry{}
+	}
+
+	// We store account id, master weight and signers only
+	return false, xdr.LedgerEntry{
+		Data: xdr.LedgerEntryData{
+			Type: xdr.LedgerEntryTypeAccount,
+			Account: &xdr.AccountEntry{
+				AccountId: accountEntry.AccountId,
+				Thresholds: [4]byte{
+					// Store master weight only
+					accountEntry.Thresholds[0], 0, 0, 0,
+				},
+				Signers: xdr.SortSignersByKey(accountEntry.Signers),
+			},
+		},
+	}
+}
+
+func (m *AccountsModule) Seed(ctx context.Context, verifier *verify.StateVerifier) error {
+	rows, err := m.Q.StreamAccounts()
+	if err != nil {
+		return errors.Wrap(err, "Error running history.Q.StreamAccounts")
+	}
+	defer rows.Close()
+
+	var account *xdr.AccountEntry
+
+	for rows.Next() {
+		var row history.AccountSigner
+		if err := rows.Scan(&row.Account, &row.Signer, &row.Weight); err != nil {
+			return errors.Wrap(err, "rows.Scan returned error")
+		}
+
+		if account == nil || account.AccountId.Address() != row.Account {
+			if account != nil {
+				// Sort signers
+				account.Signers = xdr.SortSignersByKey(account.Signers)
+
+				entry := xdr.LedgerEntry{
+					Data: xdr.LedgerEntryData{
+						Type:    xdr.LedgerEntryTypeAccount,
+						Account: account,
+					},
+				}
+				if err := verifier.Add(entry); err != nil {
+					return err
+				}
+			}
+
+			account = &xdr.AccountEntry{
+				AccountId: xdr.MustAddress(row.Account),
+				Signers:   []xdr.Signer{},
+			}
+		}
+
+		if row.Account == row.Signer {
+			// Master key
+			account.Thresholds = [4]byte{
+				// Store master weight only
+				byte(row.Weight), 0, 0, 0,
+			}
+		} else {
+			// Normal signer
+			account.Signers = append(account.Signers, xdr.Signer{
+				Key:    xdr.MustSigner(row.Signer),
+				Weight: xdr.Uint32(row.Weight),
+			})
+		}
+	}
+
+	if err := rows.Err(); err != nil {
+		return errors.Wrap(err, "rows.Err returned error")
+	}
+
+	if account == nil {
+		return nil
+	}
+
+	// Add last created in a loop account
+	entry := xdr.LedgerEntry{
+		Data: xdr.LedgerEntryData{
+			Type:    xdr.LedgerEntryTypeAccount,
+			Account: account,
+		},
+	}
+	return verifier.Add(entry)
+}
+
+// OffersModule is a verify.VerifyModule that verifies xdr.LedgerEntryTypeOffer
+// entries by comparing the offers table against checkpoint buckets.
+type OffersModule struct {
+	Q *history.Q
+}
+
+func (m *OffersModule) Types() []xdr.LedgerEntryType {
+	return []xdr.LedgerEntryType{xdr.LedgerEntryTypeOffer}
+}
+
+func (m *OffersModule) Transform(entry xdr.LedgerEntry) (bool, xdr.LedgerEntry) {
+	offerEntry := entry.Data.Offer
+
+	// We store the fields Horizon's offers table actually persists: seller,
+	// offer id, buying/selling asset, amount, price and flags.
+	return false, xdr.LedgerEntry{
+		Data: xdr.LedgerEntryData{
+			Type: xdr.LedgerEntryTypeOffer,
+			Offer: &xdr.OfferEntry{
+				SellerId: offerEntry.SellerId,
+				OfferId:  offerEntry.OfferId,
+				Selling:  offerEntry.Selling,
+				Buying:   offerEntry.Buying,
+				Amount:   offerEntry.Amount,
+				Price:    offerEntry.Price,
+				Flags:    offerEntry.Flags,
+			},
+		},
+	}
+}
+
+func (m *OffersModule) Seed(ctx context.Context, verifier *verify.StateVerifier) error {
+	rows, err := m.Q.StreamOffers()
+	if err != nil {
+		return errors.Wrap(err, "Error running history.Q.StreamOffers")
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var row history.Offer
+		if err := rows.Scan(
+			&row.SellerID,
+			&row.OfferID,
+			&row.SellingAsset,
+			&row.BuyingAsset,
+			&row.Amount,
+			&row.Pricen,
+			&row.Priced,
+			&row.Flags,
+		); err != nil {
+			return errors.Wrap(err, "rows.Scan returned error")
+		}
+
+		var sellingAsset, buyingAsset xdr.Asset
+		if err := xdr.SafeUnmarshalBase64(row.SellingAsset, &sellingAsset); err != nil {
+			return errors.Wrap(err, "Error unmarshaling selling asset")
+		}
+		if err := xdr.SafeUnmarshalBase64(row.BuyingAsset, &buyingAsset); err != nil {
+			return errors.Wrap(err, "Error unmarshaling buying asset")
+		}
+
+		entry := xdr.LedgerEntry{
+			Data: xdr.LedgerEntryData{
+				Type: xdr.LedgerEntryTypeOffer,
+				Offer: &xdr.OfferEntry{
+					SellerId: xdr.MustAddress(row.SellerID),
+					OfferId:  xdr.Int64(row.OfferID),
+					Selling:  sellingAsset,
+					Buying:   buyingAsset,
+					Amount:   xdr.Int64(row.Amount),
+					Price: xdr.Price{
+						N: xdr.Int32(row.Pricen),
+						D: xdr.Int32(row.Priced),
+					},
+					Flags: xdr.Uint32(row.Flags),
+				},
+			},
+		}
+
+		if err := verifier.Add(entry); err != nil {
+			return err
+		}
+	}
+
+	if err := rows.Err(); err != nil {
+		return errors.Wrap(err, "rows.Err returned error")
+	}
+
+	return nil
+}